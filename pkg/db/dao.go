@@ -0,0 +1,139 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package db
+
+import "database/sql"
+
+// Execer runs SQL statements. *sql.DB and *sql.Tx both satisfy it, so DAO
+// calls can run either autocommit or inside a caller-managed transaction.
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// UsersDAO persists EndUser records.
+type UsersDAO struct {
+	DB *sql.DB
+}
+
+// NewUsersDAO returns a new UsersDAO backed by db.
+func NewUsersDAO(db *sql.DB) *UsersDAO {
+	return &UsersDAO{DB: db}
+}
+
+// Insert saves user, populating user.ID with the generated primary key.
+func (u *UsersDAO) Insert(trx Execer, user *EndUser) error {
+	result, err := trx.Exec("INSERT INTO users (sub) VALUES (?)", user.Sub)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	user.ID = id
+
+	return nil
+}
+
+// Delete removes the EndUser row identified by sub.
+func (u *UsersDAO) Delete(trx Execer, sub string) error {
+	_, err := trx.Exec("DELETE FROM users WHERE sub = ?", sub)
+	return err
+}
+
+// OIDCRequestsDAO persists OIDCRequest records.
+type OIDCRequestsDAO struct {
+	DB *sql.DB
+}
+
+// NewOIDCRequestsDAO returns a new OIDCRequestsDAO backed by db.
+func NewOIDCRequestsDAO(db *sql.DB) *OIDCRequestsDAO {
+	return &OIDCRequestsDAO{DB: db}
+}
+
+// Insert saves r, populating r.ID with the generated primary key.
+func (o *OIDCRequestsDAO) Insert(trx Execer, r *OIDCRequest) error {
+	result, err := trx.Exec(
+		"INSERT INTO oidc_requests (user_id, login_challenge) VALUES (?, ?)", r.UserID, r.LoginChallenge)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	r.ID = id
+
+	return nil
+}
+
+// DeleteBySubject removes the OIDCRequest rows belonging to the EndUser
+// identified by sub.
+func (o *OIDCRequestsDAO) DeleteBySubject(trx Execer, sub string) error {
+	_, err := trx.Exec(
+		"DELETE oidc_requests FROM oidc_requests JOIN users ON oidc_requests.user_id = users.id WHERE users.sub = ?",
+		sub)
+
+	return err
+}
+
+// CredentialsOIDCProviderDAO persists CredentialsOIDCProvider records.
+type CredentialsOIDCProviderDAO struct {
+	DB *sql.DB
+}
+
+// NewCredentialsOIDCProviderDAO returns a new CredentialsOIDCProviderDAO
+// backed by db.
+func NewCredentialsOIDCProviderDAO(db *sql.DB) *CredentialsOIDCProviderDAO {
+	return &CredentialsOIDCProviderDAO{DB: db}
+}
+
+// Insert saves creds, populating creds.ID with the generated primary key.
+func (c *CredentialsOIDCProviderDAO) Insert(trx Execer, creds *CredentialsOIDCProvider) error {
+	result, err := trx.Exec(
+		`INSERT INTO credentials_oidc_provider
+			(sub, initial_id_token, initial_access_token, initial_refresh_token, claims)
+		VALUES (?, ?, ?, ?, ?)`,
+		creds.Sub, creds.InitialIDToken, creds.InitialAccessToken, creds.InitialRefreshToken, creds.Claims)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	creds.ID = id
+
+	return nil
+}
+
+// FindBySubject returns the most recently inserted CredentialsOIDCProvider
+// row for the EndUser identified by sub.
+func (c *CredentialsOIDCProviderDAO) FindBySubject(sub string) (*CredentialsOIDCProvider, error) {
+	creds := &CredentialsOIDCProvider{}
+
+	row := c.DB.QueryRow(
+		`SELECT id, sub, initial_id_token, initial_access_token, initial_refresh_token, claims
+			FROM credentials_oidc_provider
+			WHERE sub = ?
+			ORDER BY id DESC
+			LIMIT 1`,
+		sub)
+
+	if err := row.Scan(
+		&creds.ID, &creds.Sub, &creds.InitialIDToken, &creds.InitialAccessToken, &creds.InitialRefreshToken,
+		&creds.Claims); err != nil {
+		return nil, err
+	}
+
+	return creds, nil
+}
@@ -0,0 +1,54 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package db contains the persistence models used by the rp adapter
+// to track end users and their in-flight OIDC requests.
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// EndUser is a relying-party end user that has authenticated through the
+// adapter's OIDC/Hydra login flow.
+type EndUser struct {
+	ID        int64     `db:"id"`
+	Sub       string    `db:"sub"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// OIDCRequest is a Hydra login request that has been accepted on behalf of
+// an EndUser, keyed by the Hydra challenge that produced it.
+type OIDCRequest struct {
+	ID             int64  `db:"id"`
+	UserID         int64  `db:"user_id"`
+	LoginChallenge string `db:"login_challenge"`
+}
+
+// CredentialsOIDCProvider is the bundle of tokens and claims returned by the
+// upstream OIDC provider's initial token exchange for an EndUser, kept
+// around so the claims can later be re-read (and, in future, the access
+// token refreshed) without hitting the provider again. Consuming this from
+// a handler (eg. userInfoHandler) is future work: it first needs a way to
+// resolve the caller's subject from the request.
+type CredentialsOIDCProvider struct {
+	ID                  int64  `db:"id"`
+	Sub                 string `db:"sub"`
+	InitialIDToken      string `db:"initial_id_token"`
+	InitialAccessToken  string `db:"initial_access_token"`
+	InitialRefreshToken string `db:"initial_refresh_token"`
+	Claims              []byte `db:"claims"`
+}
+
+// UnmarshalConfig unmarshals the provider's JSON-encoded claims into target.
+func (c *CredentialsOIDCProvider) UnmarshalConfig(target interface{}) error {
+	if err := json.Unmarshal(c.Claims, target); err != nil {
+		return fmt.Errorf("failed to unmarshal oidc claims : %w", err)
+	}
+
+	return nil
+}
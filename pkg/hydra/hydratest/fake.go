@@ -0,0 +1,211 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package hydratest provides a FakeHydra implementing the subset of the
+// ory/hydra-client-go admin API that the adapter's Hydra interface uses,
+// driven by a handful of well-known challenge values. It is meant to be used as a drop-in
+// replacement for the real Hydra admin client in integration tests, both in
+// this module and in downstream consumers of the adapter.
+package hydratest
+
+import (
+	"errors"
+
+	"github.com/ory/hydra-client-go/client/admin"
+	"github.com/ory/hydra-client-go/models"
+)
+
+const (
+	// LoginChallengeSkipFalse is a login_challenge for which GetLoginRequest
+	// returns Skip:false, as for a user who has not yet authenticated.
+	LoginChallengeSkipFalse = "11111111-0000-0000-0000-000000000000"
+	// LoginChallengeSkipTrue is a login_challenge for which GetLoginRequest
+	// returns Skip:true, as for a user with an existing Hydra session.
+	LoginChallengeSkipTrue = "22222222-0000-0000-0000-000000000000"
+	// LoginChallengeNotFound is a login_challenge for which GetLoginRequest
+	// fails with ErrFakeLoginRequestNotFound.
+	LoginChallengeNotFound = "33333333-0000-0000-0000-000000000000"
+	// LoginChallengeAcceptFails is a login_challenge for which GetLoginRequest
+	// returns Skip:true but AcceptLoginRequest fails with
+	// ErrFakeAcceptLoginRequestFailed, as for a user with an existing Hydra
+	// session that Hydra itself then refuses to complete.
+	LoginChallengeAcceptFails = "44444444-0000-0000-0000-000000000000"
+
+	// LogoutChallengeInvalid is a logout_challenge for which GetLogoutRequest
+	// fails with ErrFakeLogoutRequestNotFound.
+	LogoutChallengeInvalid = "55555555-0000-0000-0000-000000000000"
+	// LogoutChallengeValid is a logout_challenge for which the logout flow
+	// succeeds end-to-end, redirecting to FakePostLogoutURL.
+	LogoutChallengeValid = "66666666-0000-0000-0000-000000000000"
+	// LogoutChallengeAcceptFails is a logout_challenge for which
+	// GetLogoutRequest succeeds but AcceptLogoutRequest fails with
+	// ErrFakeAcceptLogoutRequestFailed.
+	LogoutChallengeAcceptFails = "77777777-0000-0000-0000-000000000000"
+
+	// ConsentChallengeInvalid is a consent_challenge for which
+	// GetConsentRequest fails with ErrFakeConsentRequestNotFound.
+	ConsentChallengeInvalid = "88888888-0000-0000-0000-000000000000"
+	// ConsentChallengeValid is a consent_challenge for which the consent flow
+	// succeeds end-to-end, redirecting to FakeRedirectURL.
+	ConsentChallengeValid = "99999999-0000-0000-0000-000000000000"
+	// ConsentChallengeAcceptFails is a consent_challenge for which
+	// GetConsentRequest succeeds but AcceptConsentRequest and
+	// RejectConsentRequest fail with ErrFakeAcceptConsentRequestFailed.
+	ConsentChallengeAcceptFails = "aaaaaaaa-0000-0000-0000-000000000000"
+
+	// FakeSubject is the subject carried by Skip:true login requests and by
+	// every successful logout and consent request. Skip:false login requests
+	// carry no subject.
+	FakeSubject = "fake-subject"
+	// FakeClientID is the OAuth2 client ID returned by GetConsentRequest.
+	FakeClientID = "fake-client-id"
+	// FakeRedirectURL is the URL returned by a successful AcceptLoginRequest
+	// or AcceptConsentRequest.
+	FakeRedirectURL = "https://fake.hydra.example.com/login-redirect"
+	// FakePostLogoutURL is the URL returned by a successful
+	// AcceptLogoutRequest.
+	FakePostLogoutURL = "https://fake.hydra.example.com/post-logout-redirect"
+)
+
+// FakeRequestedScopes is the RequestedScope returned by GetConsentRequest.
+var FakeRequestedScopes = []string{"openid", "profile"}
+
+// ErrFakeLoginRequestNotFound is returned by GetLoginRequest for
+// LoginChallengeNotFound.
+var ErrFakeLoginRequestNotFound = errors.New("fake hydra: login request not found")
+
+// ErrFakeAcceptLoginRequestFailed is returned by AcceptLoginRequest for
+// LoginChallengeAcceptFails.
+var ErrFakeAcceptLoginRequestFailed = errors.New("fake hydra: accept login request failed")
+
+// ErrFakeLogoutRequestNotFound is returned by GetLogoutRequest for
+// LogoutChallengeInvalid.
+var ErrFakeLogoutRequestNotFound = errors.New("fake hydra: logout request not found")
+
+// ErrFakeAcceptLogoutRequestFailed is returned by AcceptLogoutRequest for
+// LogoutChallengeAcceptFails.
+var ErrFakeAcceptLogoutRequestFailed = errors.New("fake hydra: accept logout request failed")
+
+// ErrFakeConsentRequestNotFound is returned by GetConsentRequest for
+// ConsentChallengeInvalid.
+var ErrFakeConsentRequestNotFound = errors.New("fake hydra: consent request not found")
+
+// ErrFakeAcceptConsentRequestFailed is returned by AcceptConsentRequest and
+// RejectConsentRequest for ConsentChallengeAcceptFails.
+var ErrFakeAcceptConsentRequestFailed = errors.New("fake hydra: accept consent request failed")
+
+// FakeHydra implements the adapter's Hydra interface over the well-known
+// challenge constants in this package.
+type FakeHydra struct{}
+
+// New returns a new FakeHydra.
+func New() *FakeHydra {
+	return &FakeHydra{}
+}
+
+// GetLoginRequest returns a canned LoginRequest for the well-known login
+// challenges in this package.
+func (f *FakeHydra) GetLoginRequest(params *admin.GetLoginRequestParams) (*admin.GetLoginRequestOK, error) {
+	switch params.LoginChallenge {
+	case LoginChallengeNotFound:
+		return nil, ErrFakeLoginRequestNotFound
+	case LoginChallengeSkipTrue, LoginChallengeAcceptFails:
+		return &admin.GetLoginRequestOK{
+			Payload: &models.LoginRequest{
+				Challenge: params.LoginChallenge,
+				Skip:      true,
+				Subject:   FakeSubject,
+			},
+		}, nil
+	default:
+		return &admin.GetLoginRequestOK{
+			Payload: &models.LoginRequest{
+				Challenge: params.LoginChallenge,
+				Skip:      false,
+			},
+		}, nil
+	}
+}
+
+// AcceptLoginRequest accepts the login request, failing for
+// LoginChallengeAcceptFails.
+func (f *FakeHydra) AcceptLoginRequest(
+	params *admin.AcceptLoginRequestParams) (*admin.AcceptLoginRequestOK, error) {
+	if params.LoginChallenge == LoginChallengeAcceptFails {
+		return nil, ErrFakeAcceptLoginRequestFailed
+	}
+
+	return &admin.AcceptLoginRequestOK{
+		Payload: &models.CompletedRequest{RedirectTo: FakeRedirectURL},
+	}, nil
+}
+
+// GetLogoutRequest returns a canned LogoutRequest for the well-known logout
+// challenges in this package.
+func (f *FakeHydra) GetLogoutRequest(params *admin.GetLogoutRequestParams) (*admin.GetLogoutRequestOK, error) {
+	if params.LogoutChallenge == LogoutChallengeInvalid {
+		return nil, ErrFakeLogoutRequestNotFound
+	}
+
+	return &admin.GetLogoutRequestOK{
+		Payload: &models.LogoutRequest{Subject: FakeSubject},
+	}, nil
+}
+
+// AcceptLogoutRequest accepts the logout request, redirecting to
+// FakePostLogoutURL, failing for LogoutChallengeAcceptFails.
+func (f *FakeHydra) AcceptLogoutRequest(
+	params *admin.AcceptLogoutRequestParams) (*admin.AcceptLogoutRequestOK, error) {
+	if params.LogoutChallenge == LogoutChallengeAcceptFails {
+		return nil, ErrFakeAcceptLogoutRequestFailed
+	}
+
+	return &admin.AcceptLogoutRequestOK{
+		Payload: &models.CompletedRequest{RedirectTo: FakePostLogoutURL},
+	}, nil
+}
+
+// GetConsentRequest returns a canned ConsentRequest for the well-known
+// consent challenges in this package.
+func (f *FakeHydra) GetConsentRequest(params *admin.GetConsentRequestParams) (*admin.GetConsentRequestOK, error) {
+	if params.ConsentChallenge == ConsentChallengeInvalid {
+		return nil, ErrFakeConsentRequestNotFound
+	}
+
+	return &admin.GetConsentRequestOK{
+		Payload: &models.ConsentRequest{
+			Challenge:      params.ConsentChallenge,
+			Client:         &models.OAuth2Client{ClientID: FakeClientID},
+			RequestedScope: FakeRequestedScopes,
+			Subject:        FakeSubject,
+		},
+	}, nil
+}
+
+// AcceptConsentRequest accepts the consent request, failing for
+// ConsentChallengeAcceptFails.
+func (f *FakeHydra) AcceptConsentRequest(
+	params *admin.AcceptConsentRequestParams) (*admin.AcceptConsentRequestOK, error) {
+	if params.ConsentChallenge == ConsentChallengeAcceptFails {
+		return nil, ErrFakeAcceptConsentRequestFailed
+	}
+
+	return &admin.AcceptConsentRequestOK{
+		Payload: &models.CompletedRequest{RedirectTo: FakeRedirectURL},
+	}, nil
+}
+
+// RejectConsentRequest rejects the consent request, failing for
+// ConsentChallengeAcceptFails.
+func (f *FakeHydra) RejectConsentRequest(
+	params *admin.RejectConsentRequestParams) (*admin.RejectConsentRequestOK, error) {
+	if params.ConsentChallenge == ConsentChallengeAcceptFails {
+		return nil, ErrFakeAcceptConsentRequestFailed
+	}
+
+	return &admin.RejectConsentRequestOK{
+		Payload: &models.CompletedRequest{RedirectTo: FakeRedirectURL},
+	}, nil
+}
@@ -0,0 +1,119 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package hydratest
+
+import (
+	"testing"
+
+	"github.com/ory/hydra-client-go/client/admin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeHydraLogin(t *testing.T) {
+	f := New()
+
+	t.Run("skip false", func(t *testing.T) {
+		result, err := f.GetLoginRequest(admin.NewGetLoginRequestParams().WithLoginChallenge(LoginChallengeSkipFalse))
+		require.NoError(t, err)
+		require.False(t, result.Payload.Skip)
+	})
+
+	t.Run("skip true", func(t *testing.T) {
+		result, err := f.GetLoginRequest(admin.NewGetLoginRequestParams().WithLoginChallenge(LoginChallengeSkipTrue))
+		require.NoError(t, err)
+		require.True(t, result.Payload.Skip)
+		require.Equal(t, FakeSubject, result.Payload.Subject)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, err := f.GetLoginRequest(admin.NewGetLoginRequestParams().WithLoginChallenge(LoginChallengeNotFound))
+		require.ErrorIs(t, err, ErrFakeLoginRequestNotFound)
+	})
+
+	t.Run("accept succeeds", func(t *testing.T) {
+		result, err := f.AcceptLoginRequest(
+			admin.NewAcceptLoginRequestParams().WithLoginChallenge(LoginChallengeSkipTrue))
+		require.NoError(t, err)
+		require.Equal(t, FakeRedirectURL, result.Payload.RedirectTo)
+	})
+
+	t.Run("accept fails", func(t *testing.T) {
+		result, err := f.GetLoginRequest(
+			admin.NewGetLoginRequestParams().WithLoginChallenge(LoginChallengeAcceptFails))
+		require.NoError(t, err)
+		require.True(t, result.Payload.Skip)
+
+		_, err = f.AcceptLoginRequest(
+			admin.NewAcceptLoginRequestParams().WithLoginChallenge(LoginChallengeAcceptFails))
+		require.ErrorIs(t, err, ErrFakeAcceptLoginRequestFailed)
+	})
+}
+
+func TestFakeHydraLogout(t *testing.T) {
+	f := New()
+
+	t.Run("valid challenge", func(t *testing.T) {
+		result, err := f.GetLogoutRequest(admin.NewGetLogoutRequestParams().WithLogoutChallenge(LogoutChallengeValid))
+		require.NoError(t, err)
+		require.Equal(t, FakeSubject, result.Payload.Subject)
+
+		accepted, err := f.AcceptLogoutRequest(
+			admin.NewAcceptLogoutRequestParams().WithLogoutChallenge(LogoutChallengeValid))
+		require.NoError(t, err)
+		require.Equal(t, FakePostLogoutURL, accepted.Payload.RedirectTo)
+	})
+
+	t.Run("invalid challenge", func(t *testing.T) {
+		_, err := f.GetLogoutRequest(admin.NewGetLogoutRequestParams().WithLogoutChallenge(LogoutChallengeInvalid))
+		require.ErrorIs(t, err, ErrFakeLogoutRequestNotFound)
+	})
+
+	t.Run("accept fails", func(t *testing.T) {
+		_, err := f.AcceptLogoutRequest(
+			admin.NewAcceptLogoutRequestParams().WithLogoutChallenge(LogoutChallengeAcceptFails))
+		require.ErrorIs(t, err, ErrFakeAcceptLogoutRequestFailed)
+	})
+}
+
+func TestFakeHydraConsent(t *testing.T) {
+	f := New()
+
+	t.Run("valid challenge", func(t *testing.T) {
+		result, err := f.GetConsentRequest(
+			admin.NewGetConsentRequestParams().WithConsentChallenge(ConsentChallengeValid))
+		require.NoError(t, err)
+		require.Equal(t, FakeClientID, result.Payload.Client.ClientID)
+		require.Equal(t, FakeRequestedScopes, result.Payload.RequestedScope)
+
+		accepted, err := f.AcceptConsentRequest(
+			admin.NewAcceptConsentRequestParams().WithConsentChallenge(ConsentChallengeValid))
+		require.NoError(t, err)
+		require.Equal(t, FakeRedirectURL, accepted.Payload.RedirectTo)
+
+		rejected, err := f.RejectConsentRequest(
+			admin.NewRejectConsentRequestParams().WithConsentChallenge(ConsentChallengeValid))
+		require.NoError(t, err)
+		require.Equal(t, FakeRedirectURL, rejected.Payload.RedirectTo)
+	})
+
+	t.Run("invalid challenge", func(t *testing.T) {
+		_, err := f.GetConsentRequest(
+			admin.NewGetConsentRequestParams().WithConsentChallenge(ConsentChallengeInvalid))
+		require.ErrorIs(t, err, ErrFakeConsentRequestNotFound)
+	})
+
+	t.Run("accept fails", func(t *testing.T) {
+		_, err := f.AcceptConsentRequest(
+			admin.NewAcceptConsentRequestParams().WithConsentChallenge(ConsentChallengeAcceptFails))
+		require.ErrorIs(t, err, ErrFakeAcceptConsentRequestFailed)
+	})
+
+	t.Run("reject fails", func(t *testing.T) {
+		_, err := f.RejectConsentRequest(
+			admin.NewRejectConsentRequestParams().WithConsentChallenge(ConsentChallengeAcceptFails))
+		require.ErrorIs(t, err, ErrFakeAcceptConsentRequestFailed)
+	})
+}
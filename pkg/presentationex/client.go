@@ -0,0 +1,54 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package presentationex
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Client calls a remote presentation-exchange service.
+type Client struct {
+	Endpoint   string
+	HTTPClient *http.Client
+}
+
+// NewClient returns a new presentation-exchange Client pointed at endpoint.
+func NewClient(endpoint string) *Client {
+	return &Client{
+		Endpoint:   endpoint,
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// Create requests a PresentationDefinitions for the given scopes.
+func (c *Client) Create(scopes []string) (*PresentationDefinitions, error) {
+	reqBytes, err := json.Marshal(struct {
+		Scopes []string `json:"scopes"`
+	}{Scopes: scopes})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal presentation-exchange request : %w", err)
+	}
+
+	resp, err := c.HTTPClient.Post(c.Endpoint, "application/json", bytes.NewReader(reqBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to call presentation-exchange service : %w", err)
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("presentation-exchange service returned status %d", resp.StatusCode)
+	}
+
+	definitions := &PresentationDefinitions{}
+	if err := json.NewDecoder(resp.Body).Decode(definitions); err != nil {
+		return nil, fmt.Errorf("failed to decode presentation-exchange response : %w", err)
+	}
+
+	return definitions, nil
+}
@@ -0,0 +1,20 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package presentationex models requests to the presentation-exchange
+// service used to turn requested OIDC scopes into a presentation definition.
+package presentationex
+
+// PresentationDefinitions models a presentation-exchange presentation
+// definition, as consumed by the wallet during the presentation request flow.
+type PresentationDefinitions struct {
+	InputDescriptors []InputDescriptors `json:"input_descriptors"`
+}
+
+// InputDescriptors models a single presentation-exchange input descriptor.
+type InputDescriptors struct {
+	ID     string   `json:"id"`
+	Schema []string `json:"schema,omitempty"`
+}
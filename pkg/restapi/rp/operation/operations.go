@@ -0,0 +1,816 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package operation implements the relying-party adapter's REST handlers.
+// The adapter sits between Hydra (acting as the OIDC provider towards the
+// relying party's clients) and an upstream OIDC provider, bridging the two
+// with a presentation-exchange step in between.
+package operation
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"github.com/justinas/nosurf"
+	"github.com/ory/hydra-client-go/client/admin"
+	"github.com/ory/hydra-client-go/models"
+	"github.com/trustbloc/edge-core/pkg/log"
+
+	"github.com/trustbloc/edge-adapter/pkg/db"
+	"github.com/trustbloc/edge-adapter/pkg/presentationex"
+)
+
+var logger = log.New("edge-adapter/rp-operation")
+
+const (
+	hydraLoginEndpoint             = "/hydra/login"
+	hydraConsentEndpoint           = "/hydra/consent"
+	hydraLogoutEndpoint            = "/hydra/logout"
+	oidcCallbackEndpoint           = "/oidc/callback"
+	oidcManualCallbackEndpoint     = "/oidc/manual-callback"
+	oidcAuthURLEndpoint            = "/oidc/authurl"
+	presentationDefinitionEndpoint = "/presentation/create"
+	presentationResponseEndpoint   = "/presentation/response"
+	userInfoEndpoint               = "/userinfo"
+)
+
+// Handler describes a single REST endpoint registered with the router.
+type Handler interface {
+	Path() string
+	Method() string
+	Handle() http.HandlerFunc
+}
+
+// OAuth2Config abstracts the upstream OIDC provider's oauth2 client.
+type OAuth2Config interface {
+	ClientID() string
+	AuthCodeURL(state string) string
+}
+
+// OIDCTokenResponse is the result of exchanging an authorization code with
+// the upstream OIDC provider.
+type OIDCTokenResponse struct {
+	IDToken      *oidc.IDToken
+	RawIDToken   string
+	AccessToken  string
+	RefreshToken string
+	Claims       map[string]interface{}
+}
+
+// OIDCProvider exchanges an authorization code for a token response with the
+// upstream OIDC provider.
+type OIDCProvider func(code string, ctx context.Context) (*OIDCTokenResponse, error)
+
+// Hydra abstracts the subset of the Hydra admin API used by the adapter.
+type Hydra interface {
+	GetLoginRequest(*admin.GetLoginRequestParams) (*admin.GetLoginRequestOK, error)
+	AcceptLoginRequest(*admin.AcceptLoginRequestParams) (*admin.AcceptLoginRequestOK, error)
+	GetLogoutRequest(*admin.GetLogoutRequestParams) (*admin.GetLogoutRequestOK, error)
+	AcceptLogoutRequest(*admin.AcceptLogoutRequestParams) (*admin.AcceptLogoutRequestOK, error)
+	GetConsentRequest(*admin.GetConsentRequestParams) (*admin.GetConsentRequestOK, error)
+	AcceptConsentRequest(*admin.AcceptConsentRequestParams) (*admin.AcceptConsentRequestOK, error)
+	RejectConsentRequest(*admin.RejectConsentRequestParams) (*admin.RejectConsentRequestOK, error)
+}
+
+// Trx is a database transaction. DAO calls take it as their executor so that
+// Rollback actually undoes what they did.
+type Trx interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Commit() error
+	Rollback() error
+}
+
+// TrxProvider opens a new database transaction.
+type TrxProvider func(ctx context.Context, opts *sql.TxOptions) (Trx, error)
+
+// UsersDAO persists EndUser records. Insert/Delete take db.Execer (not Trx)
+// so that the concrete pkg/db DAOs, whose methods are already typed that
+// way, satisfy this interface directly - a Trx is itself a valid db.Execer.
+type UsersDAO interface {
+	Insert(trx db.Execer, u *db.EndUser) error
+	Delete(trx db.Execer, sub string) error
+}
+
+// OIDCrequestsDAO persists OIDCRequest records.
+type OIDCrequestsDAO interface {
+	Insert(trx db.Execer, r *db.OIDCRequest) error
+	DeleteBySubject(trx db.Execer, sub string) error
+}
+
+// CredentialsDAO persists CredentialsOIDCProvider records.
+type CredentialsDAO interface {
+	Insert(trx db.Execer, c *db.CredentialsOIDCProvider) error
+	FindBySubject(sub string) (*db.CredentialsOIDCProvider, error)
+}
+
+// PresentationExProvider creates presentation definitions out of requested
+// OIDC scopes.
+type PresentationExProvider interface {
+	Create(scopes []string) (*presentationex.PresentationDefinitions, error)
+}
+
+// Config configures an Operation.
+type Config struct {
+	OAuth2Config OAuth2Config
+	OIDC         OIDCProvider
+	Hydra        Hydra
+	TrxProvider  TrxProvider
+
+	UsersDAO        UsersDAO
+	OIDCrequestsDAO OIDCrequestsDAO
+	CredentialsDAO  CredentialsDAO
+
+	PresentationExProvider PresentationExProvider
+
+	// PostLogoutRedirectURL is used as a fallback redirect target for the
+	// logout flow if Hydra's accept-logout response does not carry one.
+	PostLogoutRedirectURL string
+
+	// ManualCallback switches the login flow from redirecting the user agent
+	// to the upstream OIDC provider to instead handing the authorization URL
+	// back to the caller, for headless clients that cannot be redirected
+	// (eg. CLIs). Such clients complete the flow out-of-band and paste the
+	// resulting code back in through manualCallbackHandler.
+	ManualCallback bool
+
+	// ConsentTemplateDir, if set, overrides the baked-in consent screen with
+	// a "consent.html" template loaded from this directory.
+	ConsentTemplateDir string
+}
+
+// Operation implements the adapter's REST API.
+type Operation struct {
+	oauth2Config           OAuth2Config
+	oidc                   OIDCProvider
+	hydra                  Hydra
+	trxProvider            TrxProvider
+	usersDAO               UsersDAO
+	oidcRequestsDAO        OIDCrequestsDAO
+	credentialsDAO         CredentialsDAO
+	presentationExProvider PresentationExProvider
+	postLogoutRedirectURL  string
+	manualCallback         bool
+
+	loginRequestsLock sync.Mutex
+	loginRequests     map[string]*loginRequestEntry
+
+	authCodeURLsLock sync.Mutex
+	authCodeURLs     map[string]*authCodeURLEntry
+
+	consentTemplate *template.Template
+	consentHandler  http.HandlerFunc
+}
+
+// New returns a new Operation.
+func New(config *Config) (*Operation, error) {
+	consentTemplate, err := loadConsentTemplate(config.ConsentTemplateDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load consent template : %w", err)
+	}
+
+	o := &Operation{
+		oauth2Config:           config.OAuth2Config,
+		oidc:                   config.OIDC,
+		hydra:                  config.Hydra,
+		trxProvider:            config.TrxProvider,
+		usersDAO:               config.UsersDAO,
+		oidcRequestsDAO:        config.OIDCrequestsDAO,
+		credentialsDAO:         config.CredentialsDAO,
+		presentationExProvider: config.PresentationExProvider,
+		postLogoutRedirectURL:  config.PostLogoutRedirectURL,
+		manualCallback:         config.ManualCallback,
+		loginRequests:          make(map[string]*loginRequestEntry),
+		authCodeURLs:           make(map[string]*authCodeURLEntry),
+		consentTemplate:        consentTemplate,
+	}
+
+	o.consentHandler = nosurf.New(http.HandlerFunc(o.serveConsent)).ServeHTTP
+
+	return o, nil
+}
+
+// GetRESTHandlers returns the REST handlers for this Operation.
+func (o *Operation) GetRESTHandlers() []Handler {
+	return []Handler{
+		newHandler(http.MethodGet, hydraLoginEndpoint, o.hydraLoginHandler),
+		newHandler(http.MethodGet, oidcCallbackEndpoint, o.oidcCallbackHandler),
+		newHandler(http.MethodGet, hydraConsentEndpoint, o.hydraConsentHandler),
+		newHandler(http.MethodPost, hydraConsentEndpoint, o.hydraConsentHandler),
+		newHandler(http.MethodPost, presentationDefinitionEndpoint, o.createPresentationDefinition),
+		newHandler(http.MethodPost, presentationResponseEndpoint, o.presentationResponseHandler),
+		newHandler(http.MethodGet, userInfoEndpoint, o.userInfoHandler),
+		newHandler(http.MethodGet, hydraLogoutEndpoint, o.hydraLogoutHandler),
+		newHandler(http.MethodPost, oidcManualCallbackEndpoint, o.manualCallbackHandler),
+		newHandler(http.MethodGet, oidcAuthURLEndpoint, o.authURLHandler),
+	}
+}
+
+// hydraLoginHandler initiates (or skips, on subsequent requests) the login
+// flow against the upstream OIDC provider on Hydra's behalf.
+func (o *Operation) hydraLoginHandler(w http.ResponseWriter, r *http.Request) {
+	challenge := r.URL.Query().Get("login_challenge")
+	if challenge == "" {
+		http.Error(w, "missing login_challenge", http.StatusBadRequest)
+		return
+	}
+
+	result, err := o.hydra.GetLoginRequest(admin.NewGetLoginRequestParams().WithLoginChallenge(challenge))
+	if err != nil {
+		logger.Errorf("failed to fetch hydra login request : %s", err)
+		http.Error(w, "failed to fetch hydra login request", http.StatusInternalServerError)
+
+		return
+	}
+
+	if result.Payload.Skip {
+		o.redirectAcceptedLogin(w, r, challenge, result.Payload.Subject)
+		return
+	}
+
+	state := newState()
+	o.setLoginRequestForState(state, result.Payload)
+	authCodeURL := o.oauth2Config.AuthCodeURL(state)
+	o.setAuthCodeURLForState(state, authCodeURL)
+
+	if o.manualCallback {
+		writeJSON(w, &authURLResponse{State: state, AuthCodeURL: authCodeURL})
+		return
+	}
+
+	http.Redirect(w, r, authCodeURL, http.StatusFound)
+}
+
+func (o *Operation) redirectAcceptedLogin(w http.ResponseWriter, r *http.Request, challenge, subject string) {
+	accepted, err := o.hydra.AcceptLoginRequest(
+		admin.NewAcceptLoginRequestParams().
+			WithLoginChallenge(challenge).
+			WithBody(&models.AcceptLoginRequest{Subject: &subject}))
+	if err != nil {
+		logger.Errorf("failed to accept hydra login request : %s", err)
+		http.Error(w, "failed to accept hydra login request", http.StatusInternalServerError)
+
+		return
+	}
+
+	http.Redirect(w, r, accepted.Payload.RedirectTo, http.StatusFound)
+}
+
+// oidcCallbackHandler completes the login flow once the user agent has been
+// redirected back from the upstream OIDC provider.
+func (o *Operation) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	state := r.URL.Query().Get("state")
+	code := r.URL.Query().Get("code")
+
+	loginRequest, ok := o.getLoginRequestForState(state)
+	if !ok {
+		http.Error(w, "invalid state parameter", http.StatusBadRequest)
+		return
+	}
+
+	redirectTo, err := o.exchangeAndAcceptLogin(r.Context(), loginRequest, code)
+	if err != nil {
+		logger.Errorf("%s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	http.Redirect(w, r, redirectTo, http.StatusFound)
+}
+
+// manualCallbackHandler is the headless counterpart of oidcCallbackHandler:
+// instead of the user agent being redirected back from the upstream OIDC
+// provider, a client that completed the authorization step out-of-band
+// posts the resulting state and code back in directly.
+func (o *Operation) manualCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	req := &manualCallbackReq{}
+
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, "invalid request : "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	loginRequest, ok := o.getLoginRequestForState(req.State)
+	if !ok {
+		http.Error(w, "invalid state parameter", http.StatusBadRequest)
+		return
+	}
+
+	redirectTo, err := o.exchangeAndAcceptLogin(r.Context(), loginRequest, req.Code)
+	if err != nil {
+		logger.Errorf("%s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	writeJSON(w, &manualCallbackResp{RedirectTo: redirectTo})
+}
+
+// exchangeAndAcceptLogin exchanges code for an ID token with the upstream
+// OIDC provider, persists the resulting user and login request, and accepts
+// the login request at Hydra, returning the URL Hydra wants the user
+// redirected to.
+func (o *Operation) exchangeAndAcceptLogin(
+	ctx context.Context, loginRequest *models.LoginRequest, code string) (string, error) {
+	tokens, err := o.oidc(code, ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to exchange code for id_token : %w", err)
+	}
+
+	if err := o.saveUserAndRequest(ctx, loginRequest, tokens); err != nil {
+		return "", fmt.Errorf("failed to save user and login request : %w", err)
+	}
+
+	subject := tokens.IDToken.Subject
+
+	accepted, err := o.hydra.AcceptLoginRequest(
+		admin.NewAcceptLoginRequestParams().
+			WithLoginChallenge(loginRequest.Challenge).
+			WithBody(&models.AcceptLoginRequest{Subject: &subject}))
+	if err != nil {
+		return "", fmt.Errorf("failed to accept hydra login request : %w", err)
+	}
+
+	return accepted.Payload.RedirectTo, nil
+}
+
+// authURLHandler returns the upstream authorization URL generated for a
+// pending login, for headless clients that cannot follow a redirect.
+func (o *Operation) authURLHandler(w http.ResponseWriter, r *http.Request) {
+	state := r.URL.Query().Get("state")
+	if state == "" {
+		http.Error(w, "missing state", http.StatusBadRequest)
+		return
+	}
+
+	authCodeURL, ok := o.getAuthCodeURLForState(state)
+	if !ok {
+		http.Error(w, "unknown state", http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, &authURLResponse{State: state, AuthCodeURL: authCodeURL})
+}
+
+type manualCallbackReq struct {
+	State string `json:"state"`
+	Code  string `json:"code"`
+}
+
+type manualCallbackResp struct {
+	RedirectTo string `json:"redirect_to"`
+}
+
+type authURLResponse struct {
+	State       string `json:"state"`
+	AuthCodeURL string `json:"auth_code_url"`
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	responseBytes, err := json.Marshal(v)
+	if err != nil {
+		logger.Errorf("failed to marshal response : %s", err)
+		http.Error(w, "failed to marshal response", http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if _, err := w.Write(responseBytes); err != nil {
+		logger.Errorf("failed to write response : %s", err)
+	}
+}
+
+// saveUserAndRequest persists the EndUser identified by tokens, the
+// associated login request, and the initial token/claims bundle, in a
+// single DB transaction.
+func (o *Operation) saveUserAndRequest(
+	ctx context.Context, loginRequest *models.LoginRequest, tokens *OIDCTokenResponse) error {
+	trx, err := o.trxProvider(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to open transaction : %w", err)
+	}
+
+	user := &db.EndUser{Sub: tokens.IDToken.Subject}
+
+	if err := o.usersDAO.Insert(trx, user); err != nil {
+		_ = trx.Rollback()
+		return fmt.Errorf("failed to insert user : %w", err)
+	}
+
+	oidcRequest := &db.OIDCRequest{
+		UserID:         user.ID,
+		LoginChallenge: loginRequest.Challenge,
+	}
+
+	if err := o.oidcRequestsDAO.Insert(trx, oidcRequest); err != nil {
+		_ = trx.Rollback()
+		return fmt.Errorf("failed to insert oidc request : %w", err)
+	}
+
+	creds, err := newCredentialsOIDCProvider(tokens)
+	if err != nil {
+		_ = trx.Rollback()
+		return fmt.Errorf("failed to build oidc credentials : %w", err)
+	}
+
+	if err := o.credentialsDAO.Insert(trx, creds); err != nil {
+		_ = trx.Rollback()
+		return fmt.Errorf("failed to insert oidc credentials : %w", err)
+	}
+
+	return trx.Commit()
+}
+
+// newCredentialsOIDCProvider captures the initial tokens and claims of an
+// upstream OIDC token exchange for later use (see CredentialsDAO.FindBySubject).
+func newCredentialsOIDCProvider(tokens *OIDCTokenResponse) (*db.CredentialsOIDCProvider, error) {
+	claimsBytes, err := json.Marshal(tokens.Claims)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal id_token claims : %w", err)
+	}
+
+	return &db.CredentialsOIDCProvider{
+		Sub:                 tokens.IDToken.Subject,
+		InitialIDToken:      tokens.RawIDToken,
+		InitialAccessToken:  tokens.AccessToken,
+		InitialRefreshToken: tokens.RefreshToken,
+		Claims:              claimsBytes,
+	}, nil
+}
+
+// hydraLogoutHandler tears down the adapter's session state for the user
+// and completes Hydra's logout flow.
+func (o *Operation) hydraLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	challenge := r.URL.Query().Get("logout_challenge")
+	if challenge == "" {
+		http.Error(w, "missing logout_challenge", http.StatusBadRequest)
+		return
+	}
+
+	result, err := o.hydra.GetLogoutRequest(admin.NewGetLogoutRequestParams().WithLogoutChallenge(challenge))
+	if err != nil {
+		logger.Errorf("failed to fetch hydra logout request : %s", err)
+		http.Error(w, "failed to fetch hydra logout request", http.StatusInternalServerError)
+
+		return
+	}
+
+	if err := o.deleteUserAndRequests(r.Context(), result.Payload.Subject); err != nil {
+		logger.Errorf("failed to delete user and login requests : %s", err)
+		http.Error(w, "failed to delete user and login requests", http.StatusInternalServerError)
+
+		return
+	}
+
+	accepted, err := o.hydra.AcceptLogoutRequest(admin.NewAcceptLogoutRequestParams().WithLogoutChallenge(challenge))
+	if err != nil {
+		logger.Errorf("failed to accept hydra logout request : %s", err)
+		http.Error(w, "failed to accept hydra logout request", http.StatusInternalServerError)
+
+		return
+	}
+
+	redirectTo := accepted.Payload.RedirectTo
+	if redirectTo == "" {
+		redirectTo = o.postLogoutRedirectURL
+	}
+
+	http.Redirect(w, r, redirectTo, http.StatusFound)
+}
+
+// deleteUserAndRequests removes the EndUser identified by sub and any
+// OIDCRequest rows associated with it, in a single DB transaction.
+func (o *Operation) deleteUserAndRequests(ctx context.Context, sub string) error {
+	trx, err := o.trxProvider(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to open transaction : %w", err)
+	}
+
+	if err := o.oidcRequestsDAO.DeleteBySubject(trx, sub); err != nil {
+		_ = trx.Rollback()
+		return fmt.Errorf("failed to delete oidc requests : %w", err)
+	}
+
+	if err := o.usersDAO.Delete(trx, sub); err != nil {
+		_ = trx.Rollback()
+		return fmt.Errorf("failed to delete user : %w", err)
+	}
+
+	return trx.Commit()
+}
+
+// hydraConsentHandler renders the consent screen on GET and, on POST,
+// actions the user's scope selection against Hydra. Both are routed through
+// the same CSRF-protected handler so the token minted while rendering the
+// form lines up with the one nosurf verifies on submission.
+func (o *Operation) hydraConsentHandler(w http.ResponseWriter, r *http.Request) {
+	o.consentHandler(w, r)
+}
+
+func (o *Operation) serveConsent(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		o.submitConsent(w, r)
+		return
+	}
+
+	o.renderConsent(w, r)
+}
+
+// renderConsent fetches the pending consent request from Hydra and renders
+// the requested scopes for the user to accept or reject.
+func (o *Operation) renderConsent(w http.ResponseWriter, r *http.Request) {
+	challenge := r.URL.Query().Get("consent_challenge")
+	if challenge == "" {
+		http.Error(w, "missing consent_challenge", http.StatusBadRequest)
+		return
+	}
+
+	result, err := o.hydra.GetConsentRequest(admin.NewGetConsentRequestParams().WithConsentChallenge(challenge))
+	if err != nil {
+		// Unlike the login/logout lookups, a failed fetch here almost always
+		// means the consent_challenge is unknown or has already been used
+		// (eg. the user hit back or refreshed) rather than an adapter-side
+		// failure, so it's reported as a client error.
+		logger.Errorf("failed to fetch hydra consent request : %s", err)
+		http.Error(w, "unknown or expired consent_challenge", http.StatusBadRequest)
+
+		return
+	}
+
+	clientID := ""
+	if result.Payload.Client != nil {
+		clientID = result.Payload.Client.ClientID
+	}
+
+	page := &consentPage{
+		Challenge: challenge,
+		ClientID:  clientID,
+		Scopes:    result.Payload.RequestedScope,
+		CSRFToken: nosurf.Token(r),
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if err := o.consentTemplate.Execute(w, page); err != nil {
+		logger.Errorf("failed to render consent screen : %s", err)
+		http.Error(w, "failed to render consent screen", http.StatusInternalServerError)
+	}
+}
+
+// submitConsent actions the user's accept/reject decision against Hydra.
+// nosurf has already rejected the request by this point if the CSRF token
+// didn't check out.
+func (o *Operation) submitConsent(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid request : "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	challenge := r.PostFormValue("challenge")
+	if challenge == "" {
+		http.Error(w, "missing challenge", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		completed *models.CompletedRequest
+		err       error
+	)
+
+	if r.PostFormValue("action") == "accept" {
+		completed, err = o.acceptConsent(challenge, r.PostForm["scope"])
+	} else {
+		completed, err = o.rejectConsent(challenge)
+	}
+
+	if err != nil {
+		logger.Errorf("failed to complete hydra consent request : %s", err)
+		http.Error(w, "failed to complete hydra consent request", http.StatusInternalServerError)
+
+		return
+	}
+
+	http.Redirect(w, r, completed.RedirectTo, http.StatusFound)
+}
+
+func (o *Operation) acceptConsent(challenge string, scopes []string) (*models.CompletedRequest, error) {
+	accepted, err := o.hydra.AcceptConsentRequest(
+		admin.NewAcceptConsentRequestParams().
+			WithConsentChallenge(challenge).
+			WithBody(&models.AcceptConsentRequest{GrantScope: scopes}))
+	if err != nil {
+		return nil, err
+	}
+
+	return accepted.Payload, nil
+}
+
+func (o *Operation) rejectConsent(challenge string) (*models.CompletedRequest, error) {
+	rejected, err := o.hydra.RejectConsentRequest(admin.NewRejectConsentRequestParams().WithConsentChallenge(challenge))
+	if err != nil {
+		return nil, err
+	}
+
+	return rejected.Payload, nil
+}
+
+// consentPage is the data rendered by the consent template.
+type consentPage struct {
+	Challenge string
+	ClientID  string
+	Scopes    []string
+	CSRFToken string
+}
+
+// defaultConsentTemplate is used whenever Config.ConsentTemplateDir is unset.
+const defaultConsentTemplate = `<!DOCTYPE html>
+<html>
+<head><title>Authorize {{.ClientID}}</title></head>
+<body>
+<h1>{{.ClientID}} is requesting access to your account</h1>
+<form method="POST">
+  <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+  <input type="hidden" name="challenge" value="{{.Challenge}}">
+  <ul>
+  {{range .Scopes}}
+    <li><label><input type="checkbox" name="scope" value="{{.}}" checked> {{.}}</label></li>
+  {{end}}
+  </ul>
+  <button type="submit" name="action" value="accept">Allow</button>
+  <button type="submit" name="action" value="reject">Deny</button>
+</form>
+</body>
+</html>
+`
+
+// loadConsentTemplate loads the consent screen template from dir, falling
+// back to the baked-in default if dir is empty.
+func loadConsentTemplate(dir string) (*template.Template, error) {
+	if dir == "" {
+		return template.New("consent").Parse(defaultConsentTemplate)
+	}
+
+	return template.ParseFiles(filepath.Join(dir, "consent.html"))
+}
+
+// CreatePresentationDefinitionReq is the request body for
+// createPresentationDefinition.
+type CreatePresentationDefinitionReq struct {
+	Scopes []string `json:"scopes"`
+}
+
+// createPresentationDefinition turns the requested OIDC scopes into a
+// presentation-exchange presentation definition.
+func (o *Operation) createPresentationDefinition(w http.ResponseWriter, r *http.Request) {
+	request := &CreatePresentationDefinitionReq{}
+
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		http.Error(w, "invalid request : "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	definitions, err := o.presentationExProvider.Create(request.Scopes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, definitions)
+}
+
+// presentationResponseHandler accepts the wallet's presentation-exchange
+// response.
+//
+// TODO: verify the submitted presentation.
+func (o *Operation) presentationResponseHandler(w http.ResponseWriter, r *http.Request) {
+	testResponse(w)
+}
+
+// userInfoHandler serves the OIDC userinfo endpoint.
+//
+// TODO: resolve the calling subject from the request's access token and
+// serve its claims via credentialsDAO.FindBySubject - the DAO-level read
+// path exists, but there's no subject resolution wired up yet.
+func (o *Operation) userInfoHandler(w http.ResponseWriter, r *http.Request) {
+	testResponse(w)
+}
+
+// testResponse writes a canned 200 OK response, used by endpoints that are
+// not yet fully implemented.
+func testResponse(w io.Writer) {
+	if _, err := w.Write([]byte("OK")); err != nil {
+		logger.Errorf("failed to write response : %s", err)
+	}
+}
+
+// stateTTL bounds how long an in-flight login's state is kept around, so an
+// abandoned login (the user never comes back from the OIDC provider) doesn't
+// leak an entry forever.
+const stateTTL = 10 * time.Minute
+
+type loginRequestEntry struct {
+	request   *models.LoginRequest
+	expiresAt time.Time
+}
+
+type authCodeURLEntry struct {
+	authCodeURL string
+	expiresAt   time.Time
+}
+
+func (o *Operation) setLoginRequestForState(state string, r *models.LoginRequest) {
+	o.loginRequestsLock.Lock()
+	defer o.loginRequestsLock.Unlock()
+
+	for s, entry := range o.loginRequests {
+		if time.Now().After(entry.expiresAt) {
+			delete(o.loginRequests, s)
+		}
+	}
+
+	o.loginRequests[state] = &loginRequestEntry{request: r, expiresAt: time.Now().Add(stateTTL)}
+}
+
+// getLoginRequestForState returns the login request for state and removes
+// it, so a state value cannot be replayed once it's been consumed.
+func (o *Operation) getLoginRequestForState(state string) (*models.LoginRequest, bool) {
+	o.loginRequestsLock.Lock()
+	defer o.loginRequestsLock.Unlock()
+
+	entry, ok := o.loginRequests[state]
+	delete(o.loginRequests, state)
+
+	if !ok || time.Now().After(entry.expiresAt) {
+		return nil, false
+	}
+
+	return entry.request, true
+}
+
+func (o *Operation) setAuthCodeURLForState(state, authCodeURL string) {
+	o.authCodeURLsLock.Lock()
+	defer o.authCodeURLsLock.Unlock()
+
+	for s, entry := range o.authCodeURLs {
+		if time.Now().After(entry.expiresAt) {
+			delete(o.authCodeURLs, s)
+		}
+	}
+
+	o.authCodeURLs[state] = &authCodeURLEntry{authCodeURL: authCodeURL, expiresAt: time.Now().Add(stateTTL)}
+}
+
+// getAuthCodeURLForState returns the authorization URL generated for state
+// and removes it, so a state value cannot be replayed once it's been
+// consumed.
+func (o *Operation) getAuthCodeURLForState(state string) (string, bool) {
+	o.authCodeURLsLock.Lock()
+	defer o.authCodeURLsLock.Unlock()
+
+	entry, ok := o.authCodeURLs[state]
+	delete(o.authCodeURLs, state)
+
+	if !ok || time.Now().After(entry.expiresAt) {
+		return "", false
+	}
+
+	return entry.authCodeURL, true
+}
+
+func newState() string {
+	b := make([]byte, 16)
+
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+type handler struct {
+	method string
+	path   string
+	handle http.HandlerFunc
+}
+
+func newHandler(method, path string, handle http.HandlerFunc) *handler {
+	return &handler{method: method, path: path, handle: handle}
+}
+
+func (h *handler) Method() string           { return h.method }
+func (h *handler) Path() string             { return h.path }
+func (h *handler) Handle() http.HandlerFunc { return h.handle }
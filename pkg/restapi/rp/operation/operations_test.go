@@ -12,20 +12,22 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/coreos/go-oidc"
 	_ "github.com/go-sql-driver/mysql"
-	"github.com/google/uuid"
-	"github.com/ory/hydra-client-go/client/admin"
 	"github.com/ory/hydra-client-go/models"
 	"github.com/stretchr/testify/require"
 
 	"github.com/trustbloc/edge-adapter/pkg/db"
+	"github.com/trustbloc/edge-adapter/pkg/hydra/hydratest"
 	"github.com/trustbloc/edge-adapter/pkg/presentationex"
 )
 
@@ -33,62 +35,31 @@ func TestGetRESTHandlers(t *testing.T) {
 	c, err := New(&Config{})
 	require.NoError(t, err)
 
-	require.Equal(t, 6, len(c.GetRESTHandlers()))
+	require.Equal(t, 10, len(c.GetRESTHandlers()))
 }
 
 func TestHydraLoginHandler(t *testing.T) {
 	t.Run("TODO - implement redirect to OIDC provider", func(t *testing.T) {
 		o, err := New(&Config{
 			OAuth2Config: &stubOAuth2Config{},
-			Hydra: &stubHydra{
-				loginRequestFunc: func(*admin.GetLoginRequestParams) (*admin.GetLoginRequestOK, error) {
-					return &admin.GetLoginRequestOK{
-						Payload: &models.LoginRequest{
-							Skip: false,
-						},
-					}, nil
-				},
-				acceptLoginFunc: func(*admin.AcceptLoginRequestParams) (*admin.AcceptLoginRequestOK, error) {
-					return &admin.AcceptLoginRequestOK{
-						Payload: &models.CompletedRequest{
-							RedirectTo: "http://test.hydra.com",
-						},
-					}, nil
-				},
-			},
+			Hydra:        hydratest.New(),
 		})
 		require.NoError(t, err)
 
 		r := &httptest.ResponseRecorder{}
-		o.hydraLoginHandler(r, newHydraRequest(t))
+		o.hydraLoginHandler(r, newHydraRequestWithChallenge(t, hydratest.LoginChallengeSkipFalse))
 
 		require.Equal(t, http.StatusFound, r.Code)
 	})
 	t.Run("redirects back to hydra when skipping", func(t *testing.T) {
-		const redirectURL = "http://redirect.com"
 		o, err := New(&Config{
-			Hydra: &stubHydra{
-				loginRequestFunc: func(*admin.GetLoginRequestParams) (*admin.GetLoginRequestOK, error) {
-					return &admin.GetLoginRequestOK{
-						Payload: &models.LoginRequest{
-							Skip: true,
-						},
-					}, nil
-				},
-				acceptLoginFunc: func(*admin.AcceptLoginRequestParams) (*admin.AcceptLoginRequestOK, error) {
-					return &admin.AcceptLoginRequestOK{
-						Payload: &models.CompletedRequest{
-							RedirectTo: redirectURL,
-						},
-					}, nil
-				},
-			},
+			Hydra: hydratest.New(),
 		})
 		require.NoError(t, err)
 		w := &httptest.ResponseRecorder{}
-		o.hydraLoginHandler(w, newHydraRequest(t))
+		o.hydraLoginHandler(w, newHydraRequestWithChallenge(t, hydratest.LoginChallengeSkipTrue))
 		require.Equal(t, http.StatusFound, w.Code)
-		require.Equal(t, w.Header().Get("Location"), redirectURL)
+		require.Equal(t, hydratest.FakeRedirectURL, w.Header().Get("Location"))
 	})
 	t.Run("fails on missing login_challenge", func(t *testing.T) {
 		o, err := New(&Config{})
@@ -101,42 +72,46 @@ func TestHydraLoginHandler(t *testing.T) {
 	})
 	t.Run("error while fetching hydra login request", func(t *testing.T) {
 		o, err := New(&Config{
-			Hydra: &stubHydra{
-				loginRequestFunc: func(*admin.GetLoginRequestParams) (*admin.GetLoginRequestOK, error) {
-					return nil, errors.New("test")
-				},
-			},
+			Hydra: hydratest.New(),
 		})
 		require.NoError(t, err)
 		w := &httptest.ResponseRecorder{}
-		o.hydraLoginHandler(w, newHydraRequest(t))
+		o.hydraLoginHandler(w, newHydraRequestWithChallenge(t, hydratest.LoginChallengeNotFound))
 		require.Equal(t, http.StatusInternalServerError, w.Code)
 	})
 	t.Run("error while accepting login request at hydra", func(t *testing.T) {
 		o, err := New(&Config{
-			Hydra: &stubHydra{
-				loginRequestFunc: func(*admin.GetLoginRequestParams) (*admin.GetLoginRequestOK, error) {
-					return &admin.GetLoginRequestOK{
-						Payload: &models.LoginRequest{
-							Skip: true,
-						},
-					}, nil
-				},
-				acceptLoginFunc: func(*admin.AcceptLoginRequestParams) (*admin.AcceptLoginRequestOK, error) {
-					return nil, errors.New("test")
-				},
-			},
+			Hydra: hydratest.New(),
 		})
 		require.NoError(t, err)
 		w := &httptest.ResponseRecorder{}
-		o.hydraLoginHandler(w, newHydraRequest(t))
+		o.hydraLoginHandler(w, newHydraRequestWithChallenge(t, hydratest.LoginChallengeAcceptFails))
 		require.Equal(t, http.StatusInternalServerError, w.Code)
 	})
+	t.Run("returns the auth code url instead of redirecting in manual-callback mode", func(t *testing.T) {
+		const authCodeURL = "http://oidc.example.com/auth"
+
+		o, err := New(&Config{
+			ManualCallback: true,
+			OAuth2Config:   &stubOAuth2Config{authCodeURL: authCodeURL},
+			Hydra:          hydratest.New(),
+		})
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		o.hydraLoginHandler(w, newHydraRequestWithChallenge(t, hydratest.LoginChallengeSkipFalse))
+
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp := &authURLResponse{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), resp))
+		require.Equal(t, authCodeURL, resp.AuthCodeURL)
+		require.NotEmpty(t, resp.State)
+	})
 }
 
 func TestOidcCallbackHandler(t *testing.T) {
 	t.Run("redirects to hydra", func(t *testing.T) {
-		const redirectURL = "http://hydra.example.com"
 		const code = "test_code"
 		const clientID = "test_client_id"
 
@@ -144,22 +119,17 @@ func TestOidcCallbackHandler(t *testing.T) {
 			OAuth2Config: &stubOAuth2Config{
 				clientID: clientID,
 			},
-			OIDC: func(c string, _ context.Context) (*oidc.IDToken, error) {
+			OIDC: func(c string, _ context.Context) (*OIDCTokenResponse, error) {
 				require.Equal(t, code, c)
-				return &oidc.IDToken{Subject: "test"}, nil
-			},
-			Hydra: &stubHydra{
-				acceptLoginFunc: func(*admin.AcceptLoginRequestParams) (*admin.AcceptLoginRequestOK, error) {
-					return &admin.AcceptLoginRequestOK{
-						Payload: &models.CompletedRequest{RedirectTo: redirectURL},
-					}, nil
-				},
+				return stubOIDCTokenResponse("test"), nil
 			},
+			Hydra: hydratest.New(),
 			TrxProvider: func(context.Context, *sql.TxOptions) (Trx, error) {
 				return &stubTrx{}, nil
 			},
 			UsersDAO:        &stubUsersDAO{},
 			OIDCrequestsDAO: &stubOidcRequestsDAO{},
+			CredentialsDAO:  &stubCredentialsDAO{},
 		})
 		require.NoError(t, err)
 
@@ -171,7 +141,7 @@ func TestOidcCallbackHandler(t *testing.T) {
 		c.oidcCallbackHandler(r, newOidcCallbackRequest(t, state, code))
 
 		require.Equal(t, http.StatusFound, r.Code)
-		require.Equal(t, redirectURL, r.Header().Get("Location"))
+		require.Equal(t, hydratest.FakeRedirectURL, r.Header().Get("Location"))
 	})
 
 	t.Run("bad request on invalid state", func(t *testing.T) {
@@ -187,7 +157,7 @@ func TestOidcCallbackHandler(t *testing.T) {
 	t.Run("internal error if exchanging code for id_token fails", func(t *testing.T) {
 		c, err := New(&Config{
 			OAuth2Config: &stubOAuth2Config{},
-			OIDC: func(string, context.Context) (*oidc.IDToken, error) {
+			OIDC: func(string, context.Context) (*OIDCTokenResponse, error) {
 				return nil, errors.New("test")
 			},
 		})
@@ -206,8 +176,8 @@ func TestOidcCallbackHandler(t *testing.T) {
 	t.Run("internal error if cannot open DB transaction", func(t *testing.T) {
 		c, err := New(&Config{
 			OAuth2Config: &stubOAuth2Config{},
-			OIDC: func(string, context.Context) (*oidc.IDToken, error) {
-				return &oidc.IDToken{Subject: "test"}, nil
+			OIDC: func(string, context.Context) (*OIDCTokenResponse, error) {
+				return stubOIDCTokenResponse("test"), nil
 			},
 			TrxProvider: func(context.Context, *sql.TxOptions) (Trx, error) {
 				return nil, errors.New("test")
@@ -228,23 +198,20 @@ func TestOidcCallbackHandler(t *testing.T) {
 	t.Run("internal server error if hydra fails to accept login", func(t *testing.T) {
 		c, err := New(&Config{
 			OAuth2Config: &stubOAuth2Config{},
-			OIDC: func(c string, _ context.Context) (*oidc.IDToken, error) {
-				return &oidc.IDToken{Subject: "test"}, nil
-			},
-			Hydra: &stubHydra{
-				acceptLoginFunc: func(*admin.AcceptLoginRequestParams) (*admin.AcceptLoginRequestOK, error) {
-					return nil, errors.New("test")
-				},
+			OIDC: func(c string, _ context.Context) (*OIDCTokenResponse, error) {
+				return stubOIDCTokenResponse("test"), nil
 			},
+			Hydra:           hydratest.New(),
 			TrxProvider:     func(context.Context, *sql.TxOptions) (Trx, error) { return &stubTrx{}, nil },
 			UsersDAO:        &stubUsersDAO{},
 			OIDCrequestsDAO: &stubOidcRequestsDAO{},
+			CredentialsDAO:  &stubCredentialsDAO{},
 		})
 		require.NoError(t, err)
 
 		const state = "123"
 
-		c.setLoginRequestForState(state, &models.LoginRequest{})
+		c.setLoginRequestForState(state, &models.LoginRequest{Challenge: hydratest.LoginChallengeAcceptFails})
 
 		r := &httptest.ResponseRecorder{}
 		c.oidcCallbackHandler(r, newOidcCallbackRequest(t, state, "code"))
@@ -253,13 +220,206 @@ func TestOidcCallbackHandler(t *testing.T) {
 	})
 }
 
-func TestSaveUserAndRequest(t *testing.T) {
-	t.Run("error when inserting user", func(t *testing.T) {
+func TestManualCallbackHandler(t *testing.T) {
+	t.Run("completes login and returns the redirect url as json", func(t *testing.T) {
+		const code = "test_code"
+		const state = "123"
+
 		c, err := New(&Config{
 			OAuth2Config: &stubOAuth2Config{},
-			OIDC: func(c string, _ context.Context) (*oidc.IDToken, error) {
-				return &oidc.IDToken{Subject: "test"}, nil
+			OIDC: func(c string, _ context.Context) (*OIDCTokenResponse, error) {
+				require.Equal(t, code, c)
+				return stubOIDCTokenResponse("test"), nil
 			},
+			Hydra:           hydratest.New(),
+			TrxProvider:     func(context.Context, *sql.TxOptions) (Trx, error) { return &stubTrx{}, nil },
+			UsersDAO:        &stubUsersDAO{},
+			OIDCrequestsDAO: &stubOidcRequestsDAO{},
+			CredentialsDAO:  &stubCredentialsDAO{},
+		})
+		require.NoError(t, err)
+
+		c.setLoginRequestForState(state, &models.LoginRequest{})
+
+		r := httptest.NewRecorder()
+		c.manualCallbackHandler(r, newManualCallbackRequest(t, state, code))
+
+		require.Equal(t, http.StatusOK, r.Code)
+
+		resp := &manualCallbackResp{}
+		require.NoError(t, json.Unmarshal(r.Body.Bytes(), resp))
+		require.Equal(t, hydratest.FakeRedirectURL, resp.RedirectTo)
+	})
+
+	t.Run("bad request on invalid state", func(t *testing.T) {
+		c, err := New(&Config{})
+		require.NoError(t, err)
+
+		r := httptest.NewRecorder()
+		c.manualCallbackHandler(r, newManualCallbackRequest(t, "invalid_state", "code"))
+
+		require.Equal(t, http.StatusBadRequest, r.Code)
+	})
+
+	t.Run("bad request on invalid body", func(t *testing.T) {
+		c, err := New(&Config{})
+		require.NoError(t, err)
+
+		r := httptest.NewRecorder()
+		c.manualCallbackHandler(r, &http.Request{Body: ioutil.NopCloser(bytes.NewReader([]byte("w")))})
+
+		require.Equal(t, http.StatusBadRequest, r.Code)
+	})
+
+	t.Run("internal error if exchanging code for id_token fails", func(t *testing.T) {
+		const state = "123"
+
+		c, err := New(&Config{
+			OAuth2Config: &stubOAuth2Config{},
+			OIDC: func(string, context.Context) (*OIDCTokenResponse, error) {
+				return nil, errors.New("test")
+			},
+		})
+		require.NoError(t, err)
+
+		c.setLoginRequestForState(state, &models.LoginRequest{})
+
+		r := httptest.NewRecorder()
+		c.manualCallbackHandler(r, newManualCallbackRequest(t, state, "code"))
+
+		require.Equal(t, http.StatusInternalServerError, r.Code)
+	})
+}
+
+func TestAuthURLHandler(t *testing.T) {
+	t.Run("returns the auth code url for a known state", func(t *testing.T) {
+		const authCodeURL = "http://oidc.example.com/auth"
+		const state = "123"
+
+		c, err := New(&Config{})
+		require.NoError(t, err)
+
+		c.setAuthCodeURLForState(state, authCodeURL)
+
+		r := httptest.NewRecorder()
+		c.authURLHandler(r, newOidcAuthURLRequest(t, state))
+
+		require.Equal(t, http.StatusOK, r.Code)
+
+		resp := &authURLResponse{}
+		require.NoError(t, json.Unmarshal(r.Body.Bytes(), resp))
+		require.Equal(t, authCodeURL, resp.AuthCodeURL)
+	})
+
+	t.Run("bad request on missing state", func(t *testing.T) {
+		c, err := New(&Config{})
+		require.NoError(t, err)
+
+		r := httptest.NewRecorder()
+		c.authURLHandler(r, newOidcAuthURLRequest(t, ""))
+
+		require.Equal(t, http.StatusBadRequest, r.Code)
+	})
+
+	t.Run("bad request on unknown state", func(t *testing.T) {
+		c, err := New(&Config{})
+		require.NoError(t, err)
+
+		r := httptest.NewRecorder()
+		c.authURLHandler(r, newOidcAuthURLRequest(t, "unknown"))
+
+		require.Equal(t, http.StatusBadRequest, r.Code)
+	})
+}
+
+func TestHydraLogoutHandler(t *testing.T) {
+	newOperation := func(h Hydra) *Operation {
+		o, err := New(&Config{
+			Hydra:           h,
+			TrxProvider:     func(context.Context, *sql.TxOptions) (Trx, error) { return &stubTrx{}, nil },
+			UsersDAO:        &stubUsersDAO{},
+			OIDCrequestsDAO: &stubOidcRequestsDAO{},
+		})
+		require.NoError(t, err)
+
+		return o
+	}
+
+	t.Run("deletes session state and redirects back to hydra", func(t *testing.T) {
+		o := newOperation(hydratest.New())
+
+		w := &httptest.ResponseRecorder{}
+		o.hydraLogoutHandler(w, newHydraLogoutRequest(t, hydratest.LogoutChallengeValid))
+
+		require.Equal(t, http.StatusFound, w.Code)
+		require.Equal(t, hydratest.FakePostLogoutURL, w.Header().Get("Location"))
+	})
+
+	t.Run("fails on missing logout_challenge", func(t *testing.T) {
+		o := newOperation(hydratest.New())
+
+		w := &httptest.ResponseRecorder{}
+		o.hydraLogoutHandler(w, newHydraRequestNoChallenge(t))
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("error while fetching hydra logout request", func(t *testing.T) {
+		o := newOperation(hydratest.New())
+
+		w := &httptest.ResponseRecorder{}
+		o.hydraLogoutHandler(w, newHydraLogoutRequest(t, hydratest.LogoutChallengeInvalid))
+
+		require.Equal(t, http.StatusInternalServerError, w.Code)
+	})
+
+	t.Run("error while deleting user and requests", func(t *testing.T) {
+		o, err := New(&Config{
+			Hydra:       hydratest.New(),
+			TrxProvider: func(context.Context, *sql.TxOptions) (Trx, error) { return &stubTrx{}, nil },
+			UsersDAO: &stubUsersDAO{
+				deleteErr: errors.New("test"),
+			},
+			OIDCrequestsDAO: &stubOidcRequestsDAO{},
+		})
+		require.NoError(t, err)
+
+		w := &httptest.ResponseRecorder{}
+		o.hydraLogoutHandler(w, newHydraLogoutRequest(t, hydratest.LogoutChallengeValid))
+
+		require.Equal(t, http.StatusInternalServerError, w.Code)
+	})
+
+	t.Run("error while accepting logout request at hydra", func(t *testing.T) {
+		o := newOperation(hydratest.New())
+
+		w := &httptest.ResponseRecorder{}
+		o.hydraLogoutHandler(w, newHydraLogoutRequest(t, hydratest.LogoutChallengeAcceptFails))
+
+		require.Equal(t, http.StatusInternalServerError, w.Code)
+	})
+}
+
+func TestSaveUserAndRequest(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		c, err := New(&Config{
+			TrxProvider:     func(context.Context, *sql.TxOptions) (Trx, error) { return &stubTrx{}, nil },
+			UsersDAO:        &stubUsersDAO{},
+			OIDCrequestsDAO: &stubOidcRequestsDAO{},
+			CredentialsDAO:  &stubCredentialsDAO{},
+		})
+		require.NoError(t, err)
+
+		err = c.saveUserAndRequest(
+			context.Background(),
+			&models.LoginRequest{},
+			stubOIDCTokenResponse("sub"),
+		)
+		require.NoError(t, err)
+	})
+
+	t.Run("error when inserting user", func(t *testing.T) {
+		c, err := New(&Config{
 			TrxProvider: func(context.Context, *sql.TxOptions) (Trx, error) { return &stubTrx{}, nil },
 			UsersDAO: &stubUsersDAO{
 				insertErr: errors.New("test"),
@@ -270,17 +430,13 @@ func TestSaveUserAndRequest(t *testing.T) {
 		err = c.saveUserAndRequest(
 			context.Background(),
 			&models.LoginRequest{},
-			"sub",
+			stubOIDCTokenResponse("sub"),
 		)
 		require.Error(t, err)
 	})
 
 	t.Run("error when inserting oidc request", func(t *testing.T) {
 		c, err := New(&Config{
-			OAuth2Config: &stubOAuth2Config{},
-			OIDC: func(c string, _ context.Context) (*oidc.IDToken, error) {
-				return &oidc.IDToken{Subject: "test"}, nil
-			},
 			TrxProvider: func(context.Context, *sql.TxOptions) (Trx, error) { return &stubTrx{}, nil },
 			UsersDAO:    &stubUsersDAO{},
 			OIDCrequestsDAO: &stubOidcRequestsDAO{
@@ -292,20 +448,130 @@ func TestSaveUserAndRequest(t *testing.T) {
 		err = c.saveUserAndRequest(
 			context.Background(),
 			&models.LoginRequest{},
-			"sub",
+			stubOIDCTokenResponse("sub"),
+		)
+		require.Error(t, err)
+	})
+
+	t.Run("error when inserting oidc credentials", func(t *testing.T) {
+		c, err := New(&Config{
+			TrxProvider:     func(context.Context, *sql.TxOptions) (Trx, error) { return &stubTrx{}, nil },
+			UsersDAO:        &stubUsersDAO{},
+			OIDCrequestsDAO: &stubOidcRequestsDAO{},
+			CredentialsDAO: &stubCredentialsDAO{
+				insertErr: errors.New("test"),
+			},
+		})
+		require.NoError(t, err)
+
+		err = c.saveUserAndRequest(
+			context.Background(),
+			&models.LoginRequest{},
+			stubOIDCTokenResponse("sub"),
 		)
 		require.Error(t, err)
 	})
 }
 
 func TestHydraConsentHandler(t *testing.T) {
-	c, err := New(&Config{})
-	require.NoError(t, err)
+	t.Run("renders the consent screen", func(t *testing.T) {
+		c, err := New(&Config{Hydra: hydratest.New()})
+		require.NoError(t, err)
 
-	r := &httptest.ResponseRecorder{}
-	c.hydraConsentHandler(r, nil)
+		w := httptest.NewRecorder()
+		c.hydraConsentHandler(w, newConsentGETRequest(t, hydratest.ConsentChallengeValid))
 
-	require.Equal(t, http.StatusOK, r.Code)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Contains(t, w.Body.String(), hydratest.FakeClientID)
+		require.Contains(t, w.Body.String(), "openid")
+	})
+
+	t.Run("bad request on missing consent_challenge", func(t *testing.T) {
+		c, err := New(&Config{Hydra: hydratest.New()})
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		c.hydraConsentHandler(w, newConsentGETRequest(t, ""))
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("bad request (not internal error) on unknown or expired consent_challenge", func(t *testing.T) {
+		c, err := New(&Config{Hydra: hydratest.New()})
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		c.hydraConsentHandler(w, newConsentGETRequest(t, hydratest.ConsentChallengeInvalid))
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("accepts the consent request and redirects back to hydra", func(t *testing.T) {
+		c, err := New(&Config{Hydra: hydratest.New()})
+		require.NoError(t, err)
+
+		cookies, token := renderConsentForCSRF(t, c, hydratest.ConsentChallengeValid)
+
+		w := httptest.NewRecorder()
+		c.hydraConsentHandler(w, newConsentPOSTRequest(t, cookies, url.Values{
+			"challenge":  {hydratest.ConsentChallengeValid},
+			"action":     {"accept"},
+			"scope":      {"openid", "profile"},
+			"csrf_token": {token},
+		}))
+
+		require.Equal(t, http.StatusFound, w.Code)
+		require.Equal(t, hydratest.FakeRedirectURL, w.Header().Get("Location"))
+	})
+
+	t.Run("rejects the consent request and redirects back to hydra", func(t *testing.T) {
+		c, err := New(&Config{Hydra: hydratest.New()})
+		require.NoError(t, err)
+
+		cookies, token := renderConsentForCSRF(t, c, hydratest.ConsentChallengeValid)
+
+		w := httptest.NewRecorder()
+		c.hydraConsentHandler(w, newConsentPOSTRequest(t, cookies, url.Values{
+			"challenge":  {hydratest.ConsentChallengeValid},
+			"action":     {"reject"},
+			"csrf_token": {token},
+		}))
+
+		require.Equal(t, http.StatusFound, w.Code)
+		require.Equal(t, hydratest.FakeRedirectURL, w.Header().Get("Location"))
+	})
+
+	t.Run("bad request when csrf token is missing or invalid", func(t *testing.T) {
+		c, err := New(&Config{Hydra: hydratest.New()})
+		require.NoError(t, err)
+
+		cookies, _ := renderConsentForCSRF(t, c, hydratest.ConsentChallengeValid)
+
+		w := httptest.NewRecorder()
+		c.hydraConsentHandler(w, newConsentPOSTRequest(t, cookies, url.Values{
+			"challenge":  {hydratest.ConsentChallengeValid},
+			"action":     {"accept"},
+			"csrf_token": {"not-the-real-token"},
+		}))
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("internal error when hydra fails to accept the consent request", func(t *testing.T) {
+		c, err := New(&Config{Hydra: hydratest.New()})
+		require.NoError(t, err)
+
+		cookies, token := renderConsentForCSRF(t, c, hydratest.ConsentChallengeAcceptFails)
+
+		w := httptest.NewRecorder()
+		c.hydraConsentHandler(w, newConsentPOSTRequest(t, cookies, url.Values{
+			"challenge":  {hydratest.ConsentChallengeAcceptFails},
+			"action":     {"accept"},
+			"csrf_token": {token},
+		}))
+
+		require.Equal(t, http.StatusInternalServerError, w.Code)
+	})
 }
 
 func TestCreatePresentationDefinition(t *testing.T) {
@@ -398,8 +664,8 @@ func (m *mockPresentationExProvider) Create(scopes []string) (*presentationex.Pr
 	return m.createValue, m.createErr
 }
 
-func newHydraRequest(t *testing.T) *http.Request {
-	u, err := url.Parse("http://example.com?login_challenge=" + uuid.New().String())
+func newHydraRequestWithChallenge(t *testing.T, challenge string) *http.Request {
+	u, err := url.Parse("http://example.com?login_challenge=" + challenge)
 	require.NoError(t, err)
 
 	return &http.Request{URL: u}
@@ -412,6 +678,27 @@ func newOidcCallbackRequest(t *testing.T, state, code string) *http.Request {
 	return &http.Request{URL: u}
 }
 
+func newManualCallbackRequest(t *testing.T, state, code string) *http.Request {
+	reqBytes, err := json.Marshal(manualCallbackReq{State: state, Code: code})
+	require.NoError(t, err)
+
+	return &http.Request{Body: ioutil.NopCloser(bytes.NewReader(reqBytes))}
+}
+
+func newOidcAuthURLRequest(t *testing.T, state string) *http.Request {
+	u, err := url.Parse("http://example.com?state=" + state)
+	require.NoError(t, err)
+
+	return &http.Request{URL: u}
+}
+
+func newHydraLogoutRequest(t *testing.T, challenge string) *http.Request {
+	u, err := url.Parse("http://example.com?logout_challenge=" + challenge)
+	require.NoError(t, err)
+
+	return &http.Request{URL: u}
+}
+
 func newHydraRequestNoChallenge(t *testing.T) *http.Request {
 	u, err := url.Parse("http://example.com")
 	require.NoError(t, err)
@@ -421,17 +708,45 @@ func newHydraRequestNoChallenge(t *testing.T) *http.Request {
 	}
 }
 
-type stubHydra struct {
-	loginRequestFunc func(*admin.GetLoginRequestParams) (*admin.GetLoginRequestOK, error)
-	acceptLoginFunc  func(*admin.AcceptLoginRequestParams) (*admin.AcceptLoginRequestOK, error)
+func newConsentGETRequest(t *testing.T, challenge string) *http.Request {
+	u, err := url.Parse("http://example.com?consent_challenge=" + challenge)
+	require.NoError(t, err)
+
+	return &http.Request{Method: http.MethodGet, URL: u, Header: http.Header{}}
 }
 
-func (s *stubHydra) GetLoginRequest(params *admin.GetLoginRequestParams) (*admin.GetLoginRequestOK, error) {
-	return s.loginRequestFunc(params)
+var csrfTokenInBody = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// renderConsentForCSRF renders the consent screen and returns the session
+// cookies nosurf set and the CSRF token it embedded in the form, for use in
+// a follow-up POST.
+func renderConsentForCSRF(t *testing.T, c *Operation, challenge string) ([]*http.Cookie, string) {
+	w := httptest.NewRecorder()
+	c.hydraConsentHandler(w, newConsentGETRequest(t, challenge))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	match := csrfTokenInBody.FindStringSubmatch(w.Body.String())
+	require.Len(t, match, 2)
+
+	// The token is rendered through html/template, which HTML-escapes "+" (a
+	// common character in crypto/rand-generated tokens) as "&#43;" in
+	// attribute values, so it must be unescaped before it's usable again.
+	return w.Result().Cookies(), html.UnescapeString(match[1])
 }
 
-func (s *stubHydra) AcceptLoginRequest(params *admin.AcceptLoginRequestParams) (*admin.AcceptLoginRequestOK, error) {
-	return s.acceptLoginFunc(params)
+func newConsentPOSTRequest(t *testing.T, cookies []*http.Cookie, form url.Values) *http.Request {
+	body := strings.NewReader(form.Encode())
+
+	r, err := http.NewRequest(http.MethodPost, "http://example.com", body)
+	require.NoError(t, err)
+
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+
+	return r
 }
 
 type stubOAuth2Config struct {
@@ -452,6 +767,10 @@ type stubTrx struct {
 	rollbackErr error
 }
 
+func (s *stubTrx) Exec(_ string, _ ...interface{}) (sql.Result, error) {
+	return nil, nil
+}
+
 func (s *stubTrx) Commit() error {
 	return s.commitErr
 }
@@ -463,9 +782,10 @@ func (s stubTrx) Rollback() error {
 type stubUsersDAO struct {
 	insertErr  error
 	insertFunc func(*db.EndUser) error
+	deleteErr  error
 }
 
-func (s *stubUsersDAO) Insert(u *db.EndUser) error {
+func (s *stubUsersDAO) Insert(_ db.Execer, u *db.EndUser) error {
 	if s.insertErr != nil {
 		return s.insertErr
 	}
@@ -477,12 +797,17 @@ func (s *stubUsersDAO) Insert(u *db.EndUser) error {
 	return nil
 }
 
+func (s *stubUsersDAO) Delete(_ db.Execer, sub string) error {
+	return s.deleteErr
+}
+
 type stubOidcRequestsDAO struct {
 	insertErr  error
 	insertFunc func(*db.OIDCRequest) error
+	deleteErr  error
 }
 
-func (s *stubOidcRequestsDAO) Insert(r *db.OIDCRequest) error {
+func (s *stubOidcRequestsDAO) Insert(_ db.Execer, r *db.OIDCRequest) error {
 	if s.insertErr != nil {
 		return s.insertErr
 	}
@@ -493,3 +818,40 @@ func (s *stubOidcRequestsDAO) Insert(r *db.OIDCRequest) error {
 
 	return nil
 }
+
+func (s *stubOidcRequestsDAO) DeleteBySubject(_ db.Execer, sub string) error {
+	return s.deleteErr
+}
+
+type stubCredentialsDAO struct {
+	insertErr     error
+	insertFunc    func(*db.CredentialsOIDCProvider) error
+	findBySubject *db.CredentialsOIDCProvider
+	findErr       error
+}
+
+func (s *stubCredentialsDAO) Insert(_ db.Execer, c *db.CredentialsOIDCProvider) error {
+	if s.insertErr != nil {
+		return s.insertErr
+	}
+
+	if s.insertFunc != nil {
+		return s.insertFunc(c)
+	}
+
+	return nil
+}
+
+func (s *stubCredentialsDAO) FindBySubject(sub string) (*db.CredentialsOIDCProvider, error) {
+	return s.findBySubject, s.findErr
+}
+
+func stubOIDCTokenResponse(sub string) *OIDCTokenResponse {
+	return &OIDCTokenResponse{
+		IDToken:      &oidc.IDToken{Subject: sub},
+		RawIDToken:   "test_id_token",
+		AccessToken:  "test_access_token",
+		RefreshToken: "test_refresh_token",
+		Claims:       map[string]interface{}{"sub": sub},
+	}
+}